@@ -7,8 +7,10 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"math/rand"
 	"net"
 	"net/http"
+	"sort"
 	"sync"
 	"time"
 )
@@ -50,57 +52,364 @@ type ClientInterfaceCtx interface {
 
 // HTTPUClient is a client for dealing with HTTPU (HTTP over UDP). Its typical
 // function is for HTTPMU, and particularly SSDP.
+//
+// A single background goroutine owns the underlying socket and reads
+// datagrams off it; DoWithContext registers an inbox for the duration of
+// the call and drains it instead of locking the socket for the whole
+// request/response cycle. This allows many calls (e.g. concurrent SSDP
+// searches) to be in flight on the same HTTPUClient at once.
 type HTTPUClient struct {
-	connLock sync.Mutex // Protects use of conn.
-	conn     net.PacketConn
+	// ReadBufferSize is the size, in bytes, of the buffer used to receive
+	// each datagram. It defaults to 2048, which is enough for most
+	// networks, but some devices send responses with long LOCATION, USN,
+	// or vendor headers that exceed it. Changing it after the client has
+	// been constructed has no effect; use WithReadBufferSize instead.
+	ReadBufferSize int
+
+	// Logger receives diagnostic messages (parse failures, dropped
+	// responses, suspected truncation) that would otherwise be silently
+	// swallowed. It defaults to a logger that writes via the standard log
+	// package, matching prior behaviour. Use WithLogger to replace it.
+	Logger Logger
+
+	// SendSchedule decides how the numSends retransmissions of a request
+	// are spread out in time. It defaults to FixedCadenceSchedule(5 *
+	// time.Millisecond), matching prior behaviour; use WithSendSchedule to
+	// switch to e.g. MXJitterSchedule for SSDP-compliant M-SEARCH
+	// retransmission.
+	SendSchedule SendSchedule
+
+	conn net.PacketConn
+
+	mu         sync.Mutex
+	inboxes    map[uint64]inboxRegistration
+	nextInbox  uint64
+	readerDone chan struct{} // closed once the read loop has exited.
+	readerErr  error         // valid once readerDone is closed.
+	doneOnce   sync.Once     // guards closing readerDone, shared by Close and readLoop.
+}
+
+// defaultReadBufferSize is used unless overridden by WithReadBufferSize.
+const defaultReadBufferSize = 2048
+
+// Logger is a pluggable sink for diagnostic messages produced by an
+// HTTPUClient, replacing the package-level log.Printf calls used
+// previously.
+type Logger interface {
+	Logf(format string, args ...interface{})
+}
+
+// stdLogger implements Logger by forwarding to the standard log package.
+type stdLogger struct{}
+
+func (stdLogger) Logf(format string, args ...interface{}) {
+	log.Printf(format, args...)
+}
+
+// HTTPUClientOption configures optional behaviour on an HTTPUClient at
+// construction time.
+type HTTPUClientOption func(*HTTPUClient)
+
+// WithReadBufferSize overrides the default 2048-byte read buffer used to
+// receive SSDP responses.
+func WithReadBufferSize(size int) HTTPUClientOption {
+	return func(httpu *HTTPUClient) {
+		httpu.ReadBufferSize = size
+	}
+}
+
+// WithLogger overrides the logger used for diagnostic messages.
+func WithLogger(logger Logger) HTTPUClientOption {
+	return func(httpu *HTTPUClient) {
+		httpu.Logger = logger
+	}
+}
+
+// WithSendSchedule overrides how request retransmissions are spread out
+// in time.
+func WithSendSchedule(schedule SendSchedule) HTTPUClientOption {
+	return func(httpu *HTTPUClient) {
+		httpu.SendSchedule = schedule
+	}
+}
+
+// SendSchedule decides when each of a request's retransmissions should be
+// sent, relative to the first one.
+type SendSchedule interface {
+	// Delays returns the delay, relative to the first send, before each of
+	// n total sends. The first element is conventionally 0. Implementations
+	// need not return the delays in sorted order; callers sort them.
+	Delays(n int) []time.Duration
+}
+
+// SendScheduleFunc adapts a plain function into a SendSchedule.
+type SendScheduleFunc func(n int) []time.Duration
+
+// Delays implements SendSchedule.Delays.
+func (f SendScheduleFunc) Delays(n int) []time.Duration {
+	return f(n)
+}
+
+// FixedCadenceSchedule sends n copies of a request spaced interval apart,
+// starting immediately. This is the schedule HTTPUClient used
+// unconditionally before SendSchedule was introduced.
+func FixedCadenceSchedule(interval time.Duration) SendSchedule {
+	return SendScheduleFunc(func(n int) []time.Duration {
+		delays := make([]time.Duration, n)
+		for i := range delays {
+			delays[i] = time.Duration(i) * interval
+		}
+		return delays
+	})
+}
+
+// MXJitterSchedule spreads n sends uniformly at random within [0, mx), per
+// the UPnP device architecture's guidance that M-SEARCH senders randomize
+// their retransmissions across the MX interval so that responders - who
+// are themselves told to randomize their reply within MX - don't all
+// collide at once.
+func MXJitterSchedule(mx time.Duration) SendSchedule {
+	return SendScheduleFunc(func(n int) []time.Duration {
+		delays := make([]time.Duration, n)
+		for i := range delays {
+			if mx > 0 {
+				delays[i] = time.Duration(rand.Int63n(int64(mx)))
+			}
+		}
+		sort.Slice(delays, func(i, j int) bool { return delays[i] < delays[j] })
+		return delays
+	})
+}
+
+// httpuResponse pairs a parsed response with the address it arrived from,
+// as delivered to an inbox by the read loop.
+type httpuResponse struct {
+	response *http.Response
+	addr     net.Addr
 }
 
+// ErrStopDiscovery can be returned by a DoWithCallback callback to stop
+// waiting for further responses before the request's context deadline
+// elapses.
+var ErrStopDiscovery = errors.New("httpu: stop discovery")
+
 var _ ClientInterface = &HTTPUClient{}
 var _ ClientInterfaceCtx = &HTTPUClient{}
 
 // NewHTTPUClient creates a new HTTPUClient, opening up a new UDP socket for the
 // purpose.
-func NewHTTPUClient() (*HTTPUClient, error) {
+func NewHTTPUClient(opts ...HTTPUClientOption) (*HTTPUClient, error) {
 	conn, err := net.ListenPacket("udp", ":0")
 	if err != nil {
 		return nil, err
 	}
-	return &HTTPUClient{conn: conn}, nil
+	return newHTTPUClient(conn, opts...), nil
 }
 
 // NewHTTPUClientAddr creates a new HTTPUClient which will broadcast packets
 // from the specified address, opening up a new UDP socket for the purpose on a random port
-func NewHTTPUClientAddr(addr string) (*HTTPUClient, error) {
+func NewHTTPUClientAddr(addr string, opts ...HTTPUClientOption) (*HTTPUClient, error) {
 	ip := net.ParseIP(addr)
 	if ip == nil {
 		return nil, errors.New("Invalid listening address")
 	}
 
-	return NewHTTPUClientAddrWithPort(ip.String() + ":0")
+	return NewHTTPUClientAddrWithPort(ip.String()+":0", opts...)
 }
 
 // NewHTTPUClientAddrWithPort creates a new HTTPUClient which will broadcast packets
 // from the specified address, opening up a new UDP socket for the purpose on a specific port
-func NewHTTPUClientAddrWithPort(addr string) (*HTTPUClient, error) {
+func NewHTTPUClientAddrWithPort(addr string, opts ...HTTPUClientOption) (*HTTPUClient, error) {
 	conn, err := net.ListenPacket("udp", addr)
 	if err != nil {
 		return nil, err
 	}
-	return &HTTPUClient{conn: conn}, nil
+	return newHTTPUClient(conn, opts...), nil
+}
+
+// newHTTPUClient wraps an already-open socket in an HTTPUClient and starts
+// its background read loop.
+func newHTTPUClient(conn net.PacketConn, opts ...HTTPUClientOption) *HTTPUClient {
+	httpu := &HTTPUClient{
+		ReadBufferSize: defaultReadBufferSize,
+		Logger:         stdLogger{},
+		SendSchedule:   FixedCadenceSchedule(5 * time.Millisecond),
+		conn:           conn,
+		inboxes:        make(map[uint64]inboxRegistration),
+		readerDone:     make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(httpu)
+	}
+	go httpu.readLoop(httpu.ReadBufferSize)
+	return httpu
 }
 
+// errClosed is recorded as the client's error once Close has been called,
+// so that Healthy (and anyone blocked in DoWithCallback) sees the client
+// as done immediately rather than waiting for the read loop to notice its
+// socket went away.
+var errClosed = errors.New("httpu: client closed")
+
 // Close shuts down the client. The client will no longer be useful following
 // this.
+//
+// Close marks the client unhealthy synchronously, before returning, rather
+// than relying on the background read loop to notice its socket errored
+// out: a caller that immediately does client.Close() followed by
+// pool.Release(client) must not observe a race where Healthy still
+// reports true.
 func (httpu *HTTPUClient) Close() error {
-	httpu.connLock.Lock()
-	defer httpu.connLock.Unlock()
-	return httpu.conn.Close()
+	err := httpu.conn.Close()
+	httpu.markDone(errClosed)
+	return err
+}
+
+// markDone records err as the client's terminal error and closes
+// readerDone, if that hasn't already happened. It is safe to call from
+// both Close and readLoop; only the first call takes effect.
+func (httpu *HTTPUClient) markDone(err error) {
+	httpu.doneOnce.Do(func() {
+		httpu.mu.Lock()
+		httpu.readerErr = err
+		httpu.mu.Unlock()
+		close(httpu.readerDone)
+	})
+}
+
+// Healthy reports whether the client's background read loop is still
+// running. Once the underlying socket has errored, or Close has been
+// called, it returns false and the client should be discarded rather than
+// reused - see HTTPUClientPool.
+func (httpu *HTTPUClient) Healthy() bool {
+	select {
+	case <-httpu.readerDone:
+		return false
+	default:
+		return true
+	}
+}
+
+// readLoop is the sole reader of httpu.conn. It runs for the lifetime of the
+// client, parsing each incoming datagram as an HTTP response and handing it
+// to every call currently waiting in DoWithContext whose inbox filter
+// matches it. It exits once the socket errors out (typically because Close
+// was called), marking the client done unless Close already has.
+func (httpu *HTTPUClient) readLoop(bufferSize int) {
+	responseBytes := make([]byte, bufferSize)
+	for {
+		n, addr, err := httpu.conn.ReadFrom(responseBytes)
+		if err != nil {
+			httpu.markDone(err)
+			return
+		}
+
+		// A datagram that exactly fills the buffer was very likely
+		// truncated by ReadFrom: UDP reads never return more than one
+		// packet, so a genuinely complete packet smaller than the buffer
+		// would have left at least one byte unused.
+		truncated := n == len(responseBytes)
+
+		// Parse response. There is no per-call request available here since
+		// a single datagram may be destined for any number of callers
+		// concurrently using this client, so pass a nil request.
+		response, err := http.ReadResponse(bufio.NewReader(bytes.NewBuffer(responseBytes[:n])), nil)
+		if err != nil {
+			httpu.Logger.Logf("httpu: error while parsing response: %v", err)
+			continue
+		}
+
+		// Set the related local address used to discover the device.
+		if a, ok := httpu.conn.LocalAddr().(*net.UDPAddr); ok {
+			response.Header.Add(LocalAddressHeader, a.IP.String())
+		}
+		// Record the remote address that the response was received from,
+		// rather than discarding it as before.
+		if addr != nil {
+			response.Header.Add(RemoteAddressHeader, addr.String())
+		}
+		if truncated {
+			response.Header.Set(TruncatedHeader, "true")
+			httpu.Logger.Logf("httpu: response from %v read exactly %d bytes and may have been truncated; "+
+				"consider increasing ReadBufferSize", addr, n)
+		}
+
+		httpu.dispatch(httpuResponse{response: response, addr: addr})
+	}
+}
+
+// dispatch delivers a parsed response to every inbox currently registered
+// whose filter matches it. A slow or abandoned caller cannot block the
+// read loop: delivery is best-effort.
+func (httpu *HTTPUClient) dispatch(resp httpuResponse) {
+	httpu.mu.Lock()
+	defer httpu.mu.Unlock()
+	for _, reg := range httpu.inboxes {
+		if !reg.filter.matches(resp) {
+			continue
+		}
+		select {
+		case reg.inbox <- resp:
+		default:
+			httpu.Logger.Logf("httpu: dropping response, an inbox is full")
+		}
+	}
+}
+
+// inboxRegistration pairs an inbox with the filter deciding which
+// responses are destined for it.
+type inboxRegistration struct {
+	inbox  chan httpuResponse
+	filter inboxFilter
+}
+
+// inboxFilter correlates a response with the call that should receive it.
+// SSDP doesn't carry an explicit per-call request ID, so correlation is
+// done the way real control points do it: by the ST header the responder
+// echoes back from the request that prompted it. For a request that sets
+// no ST (e.g. a direct unicast request to fetch a description), the
+// destination address of the original request is used instead, which is
+// meaningful whenever that destination isn't itself a multicast group.
+type inboxFilter struct {
+	st       string       // expected response ST header; "" to not filter on it.
+	destAddr *net.UDPAddr // where the originating request was sent.
+}
+
+// matches reports whether resp should be delivered to the inbox this
+// filter belongs to.
+func (f inboxFilter) matches(resp httpuResponse) bool {
+	if f.st != "" {
+		return resp.response.Header.Get("ST") == f.st
+	}
+	if f.destAddr != nil && !f.destAddr.IP.IsMulticast() {
+		if respAddr, ok := resp.addr.(*net.UDPAddr); ok {
+			return respAddr.IP.Equal(f.destAddr.IP)
+		}
+	}
+	// A multicast search with no ST to correlate on: there's nothing in
+	// the response that identifies which concurrent caller it's for, so
+	// fall back to delivering it to every such caller, as before.
+	return true
+}
+
+// register adds an inbox that will receive a copy of every response
+// matching filter until unregister is called with the returned id.
+func (httpu *HTTPUClient) register(inbox chan httpuResponse, filter inboxFilter) uint64 {
+	httpu.mu.Lock()
+	defer httpu.mu.Unlock()
+	id := httpu.nextInbox
+	httpu.nextInbox++
+	httpu.inboxes[id] = inboxRegistration{inbox: inbox, filter: filter}
+	return id
+}
+
+func (httpu *HTTPUClient) unregister(id uint64) {
+	httpu.mu.Lock()
+	defer httpu.mu.Unlock()
+	delete(httpu.inboxes, id)
 }
 
 // Do implements ClientInterface.Do.
-//
-// Note that at present only one concurrent connection will happen per
-// HTTPUClient.
 func (httpu *HTTPUClient) Do(
 	req *http.Request,
 	timeout time.Duration,
@@ -121,13 +430,39 @@ func (httpu *HTTPUClient) Do(
 //
 // Make sure to read the documentation on the ClientInterfaceCtx interface
 // regarding cancellation!
+//
+// It is implemented as a thin wrapper around DoWithCallback that
+// accumulates every response into a slice; use DoWithCallback directly if
+// you want to act on responses as they arrive rather than waiting for the
+// whole call to finish.
 func (httpu *HTTPUClient) DoWithContext(
 	req *http.Request,
 	numSends int,
 ) ([]*http.Response, error) {
-	httpu.connLock.Lock()
-	defer httpu.connLock.Unlock()
+	var responses []*http.Response
+	err := httpu.DoWithCallback(req, numSends, func(response *http.Response, addr net.Addr) error {
+		responses = append(responses, response)
+		return nil
+	})
+	return responses, err
+}
 
+// DoWithCallback performs a request, invoking fn with each response as it
+// is received instead of collecting them into a slice. This allows a
+// caller to act on the first matching device and stop, or to implement
+// incremental UI updates, without waiting out the full request timeout.
+//
+// If fn returns ErrStopDiscovery, DoWithCallback returns immediately
+// without a further error. Any other non-nil error returned by fn aborts
+// the call and is returned from DoWithCallback as-is.
+//
+// Make sure to read the documentation on the ClientInterfaceCtx interface
+// regarding cancellation!
+func (httpu *HTTPUClient) DoWithCallback(
+	req *http.Request,
+	numSends int,
+	fn func(*http.Response, net.Addr) error,
+) error {
 	// Create the request. This is a subset of what http.Request.Write does
 	// deliberately to avoid creating extra fields which may confuse some
 	// devices.
@@ -137,89 +472,93 @@ func (httpu *HTTPUClient) DoWithContext(
 		method = "GET"
 	}
 	if _, err := fmt.Fprintf(&requestBuf, "%s %s HTTP/1.1\r\n", method, req.URL.RequestURI()); err != nil {
-		return nil, err
+		return err
 	}
 	if err := req.Header.Write(&requestBuf); err != nil {
-		return nil, err
+		return err
 	}
 	if _, err := requestBuf.Write([]byte{'\r', '\n'}); err != nil {
-		return nil, err
+		return err
 	}
 
 	destAddr, err := net.ResolveUDPAddr("udp", req.Host)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	// Handle context deadline/timeout
-	ctx := req.Context()
-	deadline, ok := ctx.Deadline()
-	if ok {
-		if err = httpu.conn.SetDeadline(deadline); err != nil {
-			return nil, err
-		}
-	}
+	// Register an inbox before sending, so that responses arriving
+	// immediately after the first write can't be missed. The filter
+	// correlates responses to this call rather than some other
+	// concurrent caller of the same HTTPUClient - see inboxFilter.
+	inbox := make(chan httpuResponse, 32)
+	filter := inboxFilter{st: req.Header.Get("ST"), destAddr: destAddr}
+	inboxID := httpu.register(inbox, filter)
+	defer httpu.unregister(inboxID)
 
-	// Handle context cancelation
-	done := make(chan struct{})
-	defer close(done)
-	go func() {
-		select {
-		case <-ctx.Done():
-			// if context is cancelled, stop any connections by setting time in the past.
-			httpu.conn.SetDeadline(time.Now().Add(-time.Second))
-		case <-done:
+	// Send request, spaced out according to SendSchedule. Delays need not
+	// be sorted by the implementation - SendSchedule's contract puts that
+	// on us - so sort our own copy before treating it as a cumulative
+	// wait schedule.
+	delays := append([]time.Duration(nil), httpu.SendSchedule.Delays(numSends)...)
+	sort.Slice(delays, func(i, j int) bool { return delays[i] < delays[j] })
+
+	ctx := req.Context()
+	var sent time.Duration
+	for i, delay := range delays {
+		if wait := delay - sent; wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return nil
+			}
 		}
-	}()
+		sent = delay
 
-	// Send request.
-	for i := 0; i < numSends; i++ {
 		if n, err := httpu.conn.WriteTo(requestBuf.Bytes(), destAddr); err != nil {
-			return nil, err
+			return err
 		} else if n < len(requestBuf.Bytes()) {
-			return nil, fmt.Errorf("httpu: wrote %d bytes rather than full %d in request",
-				n, len(requestBuf.Bytes()))
+			return fmt.Errorf("httpu: wrote %d bytes rather than full %d in request (send %d of %d)",
+				n, len(requestBuf.Bytes()), i+1, numSends)
 		}
-		time.Sleep(5 * time.Millisecond)
 	}
 
-	// Await responses until timeout.
-	var responses []*http.Response
-	responseBytes := make([]byte, 2048)
+	// Await responses until the request's context is done, or the read
+	// loop itself has stopped (e.g. because the client was closed).
 	for {
-		// 2048 bytes should be sufficient for most networks.
-		n, _, err := httpu.conn.ReadFrom(responseBytes)
-		if err != nil {
-			if err, ok := err.(net.Error); ok {
-				if err.Timeout() {
-					break
-				}
-				if err.Temporary() {
-					// Sleep in case this is a persistent error to avoid pegging CPU until deadline.
-					time.Sleep(10 * time.Millisecond)
-					continue
+		select {
+		case resp := <-inbox:
+			if err := fn(resp.response, resp.addr); err != nil {
+				if err == ErrStopDiscovery {
+					return nil
 				}
+				return err
 			}
-			return nil, err
-		}
-
-		// Parse response.
-		response, err := http.ReadResponse(bufio.NewReader(bytes.NewBuffer(responseBytes[:n])), req)
-		if err != nil {
-			log.Printf("httpu: error while parsing response: %v", err)
-			continue
-		}
-
-		// Set the related local address used to discover the device.
-		if a, ok := httpu.conn.LocalAddr().(*net.UDPAddr); ok {
-			response.Header.Add(LocalAddressHeader, a.IP.String())
+		case <-ctx.Done():
+			return nil
+		case <-httpu.readerDone:
+			httpu.mu.Lock()
+			err := httpu.readerErr
+			httpu.mu.Unlock()
+			if err, ok := err.(net.Error); ok && err.Timeout() {
+				return nil
+			}
+			return err
 		}
-
-		responses = append(responses, response)
 	}
-
-	// Timeout reached - return discovered responses.
-	return responses, nil
 }
 
-const LocalAddressHeader = "goupnp-local-address"
+const (
+	// LocalAddressHeader carries the local IP address that a response was
+	// received on.
+	LocalAddressHeader = "goupnp-local-address"
+	// RemoteAddressHeader carries the address of the remote host that sent
+	// a response, as reported by the underlying PacketConn.
+	RemoteAddressHeader = "goupnp-remote-address"
+	// TruncatedHeader is set to "true" on a response whose datagram
+	// appears to have been truncated by ReadBufferSize. Callers that see
+	// this may want to fall back to a unicast HTTP request against the
+	// sender to fetch the untruncated headers.
+	TruncatedHeader = "goupnp-truncated"
+)
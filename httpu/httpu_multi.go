@@ -0,0 +1,171 @@
+package httpu
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// InterfaceNameHeader carries the name of the network interface that a
+	// MultiHTTPUClient response was received on.
+	InterfaceNameHeader = "goupnp-interface-name"
+	// InterfaceIndexHeader carries the index of the network interface that
+	// a MultiHTTPUClient response was received on.
+	InterfaceIndexHeader = "goupnp-interface-index"
+)
+
+// ssdpMulticastAddr is the standard SSDP multicast group and port, used to
+// join each selected interface to the group it would otherwise only see
+// unicast M-SEARCH replies on.
+var ssdpMulticastAddr = &net.UDPAddr{IP: net.IPv4(239, 255, 255, 250), Port: 1900}
+
+// InterfaceFilter decides whether an interface should be used for
+// discovery by NewMultiHTTPUClient.
+type InterfaceFilter func(net.Interface) bool
+
+// DefaultInterfaceFilter selects interfaces that are up, support
+// multicast, and are not the loopback interface - the set that SSDP
+// discovery should normally be sent out on.
+func DefaultInterfaceFilter(ifi net.Interface) bool {
+	return ifi.Flags&net.FlagUp != 0 &&
+		ifi.Flags&net.FlagMulticast != 0 &&
+		ifi.Flags&net.FlagLoopback == 0
+}
+
+// MultiHTTPUClient fans a single logical HTTPU request out across a set of
+// network interfaces, merging the responses collected on each one. This is
+// necessary to discover UPnP devices that are only reachable via a
+// particular interface (Wi-Fi, wired, a VPN, a docker bridge, and so on),
+// since a single socket bound to ":0" only ever sees whichever interface
+// the OS happened to route the request through.
+type MultiHTTPUClient struct {
+	clients []multiClientEntry
+}
+
+type multiClientEntry struct {
+	ifi    net.Interface
+	client *HTTPUClient
+}
+
+var _ ClientInterface = &MultiHTTPUClient{}
+var _ ClientInterfaceCtx = &MultiHTTPUClient{}
+
+// NewHTTPUClientMulti creates a MultiHTTPUClient with one HTTPUClient
+// joined to the SSDP multicast group on each of ifis. opts are applied to
+// every per-interface HTTPUClient, so e.g. WithReadBufferSize or
+// WithSendSchedule reach multi-interface discovery the same way they do a
+// plain HTTPUClient.
+func NewHTTPUClientMulti(ifis []net.Interface, opts ...HTTPUClientOption) (*MultiHTTPUClient, error) {
+	multi := &MultiHTTPUClient{}
+	for _, ifi := range ifis {
+		conn, err := net.ListenMulticastUDP("udp4", &ifi, ssdpMulticastAddr)
+		if err != nil {
+			multi.Close()
+			return nil, fmt.Errorf("httpu: failed binding to interface %s: %w", ifi.Name, err)
+		}
+		multi.clients = append(multi.clients, multiClientEntry{
+			ifi:    ifi,
+			client: newHTTPUClient(conn, opts...),
+		})
+	}
+	return multi, nil
+}
+
+// NewMultiHTTPUClient creates a MultiHTTPUClient bound to every interface on
+// the host for which filter returns true. Pass DefaultInterfaceFilter for
+// the usual "every live, non-loopback, multicast-capable interface"
+// behaviour. opts are applied to every per-interface HTTPUClient.
+func NewMultiHTTPUClient(filter InterfaceFilter, opts ...HTTPUClientOption) (*MultiHTTPUClient, error) {
+	all, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	var selected []net.Interface
+	for _, ifi := range all {
+		if filter(ifi) {
+			selected = append(selected, ifi)
+		}
+	}
+	return NewHTTPUClientMulti(selected, opts...)
+}
+
+// Close shuts down every per-interface client. It returns the first error
+// encountered, if any, but always attempts to close all of them.
+func (multi *MultiHTTPUClient) Close() error {
+	var firstErr error
+	for _, entry := range multi.clients {
+		if err := entry.client.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Do implements ClientInterface.Do.
+func (multi *MultiHTTPUClient) Do(
+	req *http.Request,
+	timeout time.Duration,
+	numSends int,
+) ([]*http.Response, error) {
+	ctx := req.Context()
+	if timeout > 0 {
+		var cancel func()
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
+
+	return multi.DoWithContext(req, numSends)
+}
+
+// DoWithContext implements ClientInterfaceCtx.DoWithContext. It sends req
+// out every interface this client was constructed with, concurrently, and
+// merges the results. Each response has InterfaceNameHeader and
+// InterfaceIndexHeader set to identify the interface it arrived on, in
+// addition to the headers that the underlying per-interface HTTPUClient
+// already sets.
+func (multi *MultiHTTPUClient) DoWithContext(
+	req *http.Request,
+	numSends int,
+) ([]*http.Response, error) {
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		all      []*http.Response
+		firstErr error
+	)
+
+	for _, entry := range multi.clients {
+		wg.Add(1)
+		go func(entry multiClientEntry) {
+			defer wg.Done()
+
+			responses, err := entry.client.DoWithContext(req, numSends)
+			if err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = fmt.Errorf("httpu: interface %s: %w", entry.ifi.Name, err)
+				}
+				mu.Unlock()
+				return
+			}
+
+			for _, response := range responses {
+				response.Header.Set(InterfaceNameHeader, entry.ifi.Name)
+				response.Header.Set(InterfaceIndexHeader, strconv.Itoa(entry.ifi.Index))
+			}
+
+			mu.Lock()
+			all = append(all, responses...)
+			mu.Unlock()
+		}(entry)
+	}
+
+	wg.Wait()
+	return all, firstErr
+}
@@ -0,0 +1,231 @@
+package httpu
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// ErrPoolClosed is returned by Acquire once the pool has been closed.
+var ErrPoolClosed = errors.New("httpu: pool closed")
+
+// HTTPUClientPool lazily creates and reuses HTTPUClient instances, keyed
+// per network interface, instead of opening and closing a socket for every
+// discovery. This matters for services that continuously probe the
+// network (media servers, home-automation bridges), where doing so on
+// every scan burns file descriptors and accumulates read-loop goroutines.
+//
+// Callers do:
+//
+//	client, err := pool.Acquire(ctx, iface)
+//	...
+//	pool.Release(client)
+//
+// instead of constructing a fresh HTTPUClient per discovery.
+type HTTPUClientPool struct {
+	// MaxClients caps the number of live HTTPUClients the pool will keep
+	// per interface. Acquire blocks, respecting ctx, once this many
+	// clients for that interface are checked out. Zero means unbounded.
+	MaxClients int
+
+	// Opts are applied to every HTTPUClient the pool creates.
+	Opts []HTTPUClientOption
+
+	mu     sync.Mutex
+	closed bool
+	perIfi map[string]*clientFreeList
+	keyOf  map[*HTTPUClient]string
+}
+
+// clientFreeList is the per-interface bookkeeping for an HTTPUClientPool.
+type clientFreeList struct {
+	idle    []*HTTPUClient
+	inUse   int
+	waiters []chan struct{}
+}
+
+// NewHTTPUClientPool creates an HTTPUClientPool. maxClients bounds how many
+// concurrently-checked-out clients are allowed per interface; pass 0 for
+// no bound. opts are applied to every HTTPUClient the pool creates.
+func NewHTTPUClientPool(maxClients int, opts ...HTTPUClientOption) *HTTPUClientPool {
+	return &HTTPUClientPool{
+		MaxClients: maxClients,
+		Opts:       opts,
+		perIfi:     make(map[string]*clientFreeList),
+		keyOf:      make(map[*HTTPUClient]string),
+	}
+}
+
+// Acquire returns an HTTPUClient bound to iface, creating one if none is
+// idle and the per-interface MaxClients limit hasn't been reached. Pass
+// the zero net.Interface{} to get a client bound to all interfaces (":0"),
+// matching NewHTTPUClient.
+//
+// Acquire blocks until a client becomes available, ctx is done, or the
+// pool is closed.
+func (pool *HTTPUClientPool) Acquire(ctx context.Context, iface net.Interface) (*HTTPUClient, error) {
+	key := iface.Name
+	for {
+		pool.mu.Lock()
+		if pool.closed {
+			pool.mu.Unlock()
+			return nil, ErrPoolClosed
+		}
+
+		list := pool.perIfi[key]
+		if list == nil {
+			list = &clientFreeList{}
+			pool.perIfi[key] = list
+		}
+
+		// Prefer reusing a healthy idle client over opening a new socket.
+		for len(list.idle) > 0 {
+			client := list.idle[len(list.idle)-1]
+			list.idle = list.idle[:len(list.idle)-1]
+			if client.Healthy() {
+				list.inUse++
+				pool.mu.Unlock()
+				return client, nil
+			}
+			delete(pool.keyOf, client)
+			client.Close()
+		}
+
+		if pool.MaxClients <= 0 || list.inUse < pool.MaxClients {
+			client, err := pool.newClient(iface)
+			if err != nil {
+				pool.mu.Unlock()
+				return nil, err
+			}
+			list.inUse++
+			pool.keyOf[client] = key
+			pool.mu.Unlock()
+			return client, nil
+		}
+
+		// At the limit for this interface: wait for a Release or Close.
+		wait := make(chan struct{})
+		list.waiters = append(list.waiters, wait)
+		pool.mu.Unlock()
+
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			// Remove our own entry so a stale, abandoned waiter can never
+			// be popped ahead of a still-waiting caller and absorb a
+			// wakeup that nobody is listening for.
+			pool.removeWaiter(key, wait)
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// removeWaiter deletes wait from key's waiter queue, if it's still there.
+// It's a no-op if wait was already popped and woken by Release or Close.
+func (pool *HTTPUClientPool) removeWaiter(key string, wait chan struct{}) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	list := pool.perIfi[key]
+	if list == nil {
+		return
+	}
+	for i, w := range list.waiters {
+		if w == wait {
+			list.waiters = append(list.waiters[:i], list.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+// Release returns a client acquired via Acquire to the pool. A client
+// that is no longer Healthy, or whose pool has been closed, is closed
+// instead of being made available for reuse. Releasing a client that
+// wasn't obtained from this pool closes it and is otherwise a no-op.
+func (pool *HTTPUClientPool) Release(client *HTTPUClient) {
+	pool.mu.Lock()
+
+	key, ok := pool.keyOf[client]
+	if !ok {
+		pool.mu.Unlock()
+		client.Close()
+		return
+	}
+
+	list := pool.perIfi[key]
+	list.inUse--
+
+	if pool.closed || !client.Healthy() {
+		delete(pool.keyOf, client)
+		// The discarded client still frees a slot under MaxClients, so let
+		// one waiter retry and open a replacement.
+		var wake chan struct{}
+		if len(list.waiters) > 0 {
+			wake, list.waiters = list.waiters[0], list.waiters[1:]
+		}
+		pool.mu.Unlock()
+		client.Close()
+		if wake != nil {
+			close(wake)
+		}
+		return
+	}
+
+	list.idle = append(list.idle, client)
+
+	var wake chan struct{}
+	if len(list.waiters) > 0 {
+		wake, list.waiters = list.waiters[0], list.waiters[1:]
+	}
+	pool.mu.Unlock()
+
+	if wake != nil {
+		close(wake)
+	}
+}
+
+// Close shuts down every idle client held by the pool and prevents further
+// Acquire calls from succeeding. Clients still checked out are closed as
+// they are Released. It returns the first error encountered closing an
+// idle client, if any.
+func (pool *HTTPUClientPool) Close() error {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	pool.closed = true
+
+	var firstErr error
+	for _, list := range pool.perIfi {
+		for _, client := range list.idle {
+			delete(pool.keyOf, client)
+			if err := client.Close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		list.idle = nil
+
+		for _, wait := range list.waiters {
+			close(wait)
+		}
+		list.waiters = nil
+	}
+	return firstErr
+}
+
+// newClient opens a new HTTPUClient for iface. The zero net.Interface{}
+// yields a client bound to all interfaces; otherwise the client is joined
+// to the SSDP multicast group on that interface, exactly like
+// MultiHTTPUClient does, so a pooled per-interface client reliably
+// receives multicast-only responders too, not just unicast replies.
+func (pool *HTTPUClientPool) newClient(iface net.Interface) (*HTTPUClient, error) {
+	if iface.Name == "" {
+		return NewHTTPUClient(pool.Opts...)
+	}
+
+	conn, err := net.ListenMulticastUDP("udp4", &iface, ssdpMulticastAddr)
+	if err != nil {
+		return nil, fmt.Errorf("httpu: failed binding to interface %s: %w", iface.Name, err)
+	}
+	return newHTTPUClient(conn, pool.Opts...), nil
+}
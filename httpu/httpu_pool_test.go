@@ -0,0 +1,90 @@
+package httpu
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHTTPUClientPoolReusesReleasedClient(t *testing.T) {
+	pool := NewHTTPUClientPool(0)
+	defer pool.Close()
+
+	ctx := context.Background()
+	client, err := pool.Acquire(ctx, net.Interface{})
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	pool.Release(client)
+
+	again, err := pool.Acquire(ctx, net.Interface{})
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	if again != client {
+		t.Fatalf("expected the released client to be reused, got a different client")
+	}
+}
+
+func TestHTTPUClientPoolMaxClientsBlocksUntilRelease(t *testing.T) {
+	pool := NewHTTPUClientPool(1)
+	defer pool.Close()
+
+	ctx := context.Background()
+	first, err := pool.Acquire(ctx, net.Interface{})
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+
+	blockedCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if _, err := pool.Acquire(blockedCtx, net.Interface{}); err != blockedCtx.Err() {
+		t.Fatalf("expected Acquire to block until the context deadline, got err=%v", err)
+	}
+
+	pool.Release(first)
+
+	unblockedCtx, cancel2 := context.WithTimeout(ctx, time.Second)
+	defer cancel2()
+	second, err := pool.Acquire(unblockedCtx, net.Interface{})
+	if err != nil {
+		t.Fatalf("Acquire after Release: %v", err)
+	}
+	if second != first {
+		t.Fatalf("expected the released client to be handed back out")
+	}
+}
+
+func TestHTTPUClientPoolDiscardsUnhealthyClient(t *testing.T) {
+	pool := NewHTTPUClientPool(0)
+	defer pool.Close()
+
+	ctx := context.Background()
+	client, err := pool.Acquire(ctx, net.Interface{})
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	client.Close() // simulate the underlying socket erroring out.
+	pool.Release(client)
+
+	again, err := pool.Acquire(ctx, net.Interface{})
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	defer pool.Release(again)
+	if again == client {
+		t.Fatalf("expected an unhealthy client to be discarded rather than reused")
+	}
+}
+
+func TestHTTPUClientPoolCloseRejectsFurtherAcquire(t *testing.T) {
+	pool := NewHTTPUClientPool(0)
+	if err := pool.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if _, err := pool.Acquire(context.Background(), net.Interface{}); err != ErrPoolClosed {
+		t.Fatalf("expected ErrPoolClosed, got %v", err)
+	}
+}
@@ -0,0 +1,320 @@
+package httpu
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDevice is a minimal UDP responder used to simulate an SSDP device:
+// it echoes an HTTP response carrying the given ST header back to whoever
+// sent it a datagram.
+type fakeDevice struct {
+	conn net.PacketConn
+	st   string
+}
+
+func newFakeDevice(t *testing.T, st string) *fakeDevice {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	d := &fakeDevice{conn: conn, st: st}
+	go d.serve()
+	return d
+}
+
+func (d *fakeDevice) serve() {
+	buf := make([]byte, 2048)
+	for {
+		_, addr, err := d.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		resp := fmt.Sprintf("HTTP/1.1 200 OK\r\nST: %s\r\nContent-Length: 0\r\n\r\n", d.st)
+		d.conn.WriteTo([]byte(resp), addr)
+	}
+}
+
+func (d *fakeDevice) addr() string {
+	return d.conn.LocalAddr().String()
+}
+
+func (d *fakeDevice) Close() {
+	d.conn.Close()
+}
+
+func newSearchRequest(t *testing.T, host, st string) *http.Request {
+	t.Helper()
+	req, err := http.NewRequest("M-SEARCH", "*", nil)
+	if err != nil {
+		t.Fatalf("failed to build request: %v", err)
+	}
+	req.Host = host
+	req.Header.Set("ST", st)
+	req.Header.Set("MAN", `"ssdp:discover"`)
+	return req
+}
+
+// TestDoWithContextConcurrentCallersDoNotCrossTalk exercises two
+// concurrent DoWithContext calls sharing a single HTTPUClient, each
+// talking to its own fake device with a distinct ST. Each caller must only
+// see responses carrying its own ST - not the other caller's.
+func TestDoWithContextConcurrentCallersDoNotCrossTalk(t *testing.T) {
+	deviceA := newFakeDevice(t, "urn:A")
+	defer deviceA.Close()
+	deviceB := newFakeDevice(t, "urn:B")
+	defer deviceB.Close()
+
+	client, err := NewHTTPUClient()
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+
+	reqA := newSearchRequest(t, deviceA.addr(), "urn:A").WithContext(ctx)
+	reqB := newSearchRequest(t, deviceB.addr(), "urn:B").WithContext(ctx)
+
+	type result struct {
+		responses []*http.Response
+		err       error
+	}
+	resultsA := make(chan result, 1)
+	resultsB := make(chan result, 1)
+
+	go func() {
+		responses, err := client.DoWithContext(reqA, 1)
+		resultsA <- result{responses, err}
+	}()
+	go func() {
+		responses, err := client.DoWithContext(reqB, 1)
+		resultsB <- result{responses, err}
+	}()
+
+	rA := <-resultsA
+	rB := <-resultsB
+
+	if rA.err != nil {
+		t.Fatalf("caller A: %v", rA.err)
+	}
+	if rB.err != nil {
+		t.Fatalf("caller B: %v", rB.err)
+	}
+	if len(rA.responses) == 0 {
+		t.Fatalf("caller A received no responses")
+	}
+	if len(rB.responses) == 0 {
+		t.Fatalf("caller B received no responses")
+	}
+	for _, resp := range rA.responses {
+		if got := resp.Header.Get("ST"); got != "urn:A" {
+			t.Errorf("caller A received a response meant for %q", got)
+		}
+	}
+	for _, resp := range rB.responses {
+		if got := resp.Header.Get("ST"); got != "urn:B" {
+			t.Errorf("caller B received a response meant for %q", got)
+		}
+	}
+}
+
+// TestReadBufferSizeTruncationDetected checks that a response too big for
+// ReadBufferSize is flagged via TruncatedHeader rather than silently handed
+// to the caller as if it were complete.
+func TestReadBufferSizeTruncationDetected(t *testing.T) {
+	const st = "urn:long-response"
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer conn.Close()
+
+	// A body long enough that, once the status line and headers are
+	// counted, the whole datagram overflows the tiny ReadBufferSize below -
+	// while the header block alone still fits, so the truncated read still
+	// parses as a valid (short-bodied) HTTP response.
+	body := make([]byte, 256)
+	for i := range body {
+		body[i] = 'x'
+	}
+	go func() {
+		buf := make([]byte, 2048)
+		_, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		resp := fmt.Sprintf("HTTP/1.1 200 OK\r\nST: %s\r\nContent-Length: %d\r\n\r\n%s", st, len(body), body)
+		conn.WriteTo([]byte(resp), addr)
+	}()
+
+	client, err := NewHTTPUClient(WithReadBufferSize(64))
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	req := newSearchRequest(t, conn.LocalAddr().String(), st).WithContext(ctx)
+
+	responses, err := client.DoWithContext(req, 1)
+	if err != nil {
+		t.Fatalf("DoWithContext: %v", err)
+	}
+	if len(responses) == 0 {
+		t.Fatalf("expected at least one (truncated) response")
+	}
+	if got := responses[0].Header.Get(TruncatedHeader); got != "true" {
+		t.Fatalf("expected %s to be set to true on a response that filled the read buffer, got %q", TruncatedHeader, got)
+	}
+}
+
+// TestFixedCadenceSchedule checks that FixedCadenceSchedule returns n
+// delays spaced interval apart, starting at zero.
+func TestFixedCadenceSchedule(t *testing.T) {
+	delays := FixedCadenceSchedule(10 * time.Millisecond).Delays(3)
+	want := []time.Duration{0, 10 * time.Millisecond, 20 * time.Millisecond}
+	if len(delays) != len(want) {
+		t.Fatalf("got %d delays, want %d", len(delays), len(want))
+	}
+	for i, d := range delays {
+		if d != want[i] {
+			t.Errorf("delays[%d] = %v, want %v", i, d, want[i])
+		}
+	}
+}
+
+// TestMXJitterSchedule checks that MXJitterSchedule returns n delays, all
+// within [0, mx), already sorted in non-decreasing order.
+func TestMXJitterSchedule(t *testing.T) {
+	const mx = 50 * time.Millisecond
+	delays := MXJitterSchedule(mx).Delays(20)
+	if len(delays) != 20 {
+		t.Fatalf("got %d delays, want 20", len(delays))
+	}
+	for i, d := range delays {
+		if d < 0 || d >= mx {
+			t.Errorf("delays[%d] = %v, out of range [0, %v)", i, d, mx)
+		}
+		if i > 0 && delays[i-1] > d {
+			t.Errorf("delays not sorted: delays[%d]=%v > delays[%d]=%v", i-1, delays[i-1], i, d)
+		}
+	}
+}
+
+// TestDoWithCallbackSortsUnsortedSendSchedule checks that DoWithCallback
+// sends retransmissions in non-decreasing time order even when the
+// configured SendSchedule returns its delays out of order - SendSchedule's
+// contract lets implementations do that and leaves sorting to the caller.
+func TestDoWithCallbackSortsUnsortedSendSchedule(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer conn.Close()
+
+	var mu sync.Mutex
+	var arrivals []time.Duration
+	start := time.Now()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, 2048)
+		for i := 0; i < 3; i++ {
+			if _, _, err := conn.ReadFrom(buf); err != nil {
+				return
+			}
+			mu.Lock()
+			arrivals = append(arrivals, time.Since(start))
+			mu.Unlock()
+		}
+	}()
+
+	unsorted := SendScheduleFunc(func(n int) []time.Duration {
+		return []time.Duration{60 * time.Millisecond, 0, 30 * time.Millisecond}
+	})
+	client, err := NewHTTPUClient(WithSendSchedule(unsorted))
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	req := newSearchRequest(t, conn.LocalAddr().String(), "urn:unused").WithContext(ctx)
+
+	if err := client.DoWithCallback(req, 3, func(resp *http.Response, addr net.Addr) error {
+		return nil
+	}); err != nil {
+		t.Fatalf("DoWithCallback: %v", err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for all 3 sends to arrive")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(arrivals) != 3 {
+		t.Fatalf("got %d arrivals, want 3", len(arrivals))
+	}
+	for i := 1; i < len(arrivals); i++ {
+		if arrivals[i] < arrivals[i-1] {
+			t.Fatalf("sends did not arrive in non-decreasing order: %v", arrivals)
+		}
+	}
+	// Sorted, the schedule sends at 0, 30ms and 60ms, about 30ms apart;
+	// taken in the order given, the first two would go out together at
+	// 60ms and the third at 90ms.
+	for i := 1; i < len(arrivals); i++ {
+		if gap := arrivals[i] - arrivals[i-1]; gap < 15*time.Millisecond {
+			t.Fatalf("sends were not spaced out by the sorted schedule: %v", arrivals)
+		}
+	}
+}
+
+// TestDoWithCallbackStopsEarly checks that returning ErrStopDiscovery from
+// the callback returns before the request's context deadline elapses.
+func TestDoWithCallbackStopsEarly(t *testing.T) {
+	device := newFakeDevice(t, "urn:A")
+	defer device.Close()
+
+	client, err := NewHTTPUClient()
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	req := newSearchRequest(t, device.addr(), "urn:A").WithContext(ctx)
+
+	seen := 0
+	start := time.Now()
+	err = client.DoWithCallback(req, 1, func(resp *http.Response, addr net.Addr) error {
+		seen++
+		return ErrStopDiscovery
+	})
+	elapsed := time.Since(start)
+
+	if err != nil {
+		t.Fatalf("DoWithCallback: %v", err)
+	}
+	if seen != 1 {
+		t.Fatalf("expected exactly 1 response before stopping, got %d", seen)
+	}
+	if elapsed >= time.Second {
+		t.Fatalf("DoWithCallback took %v, expected it to stop well before the 2s deadline", elapsed)
+	}
+}